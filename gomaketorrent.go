@@ -24,26 +24,75 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha1"
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/fuchsi/torrentfile"
+	"github.com/fuchsi/gomaketorrent/torrentfile"
 	"github.com/pborman/getopt/v2"
 )
 
 const VERSION = "v0.1.0"
 
+// announceTiers implements getopt.Value to build a BEP 12 multi-tier
+// announce-list: each --announce occurrence adds one tier, with multiple
+// URLs within that tier separated by commas.
+type announceTiers [][]string
+
+func (a *announceTiers) Set(value string, opt getopt.Option) error {
+	*a = append(*a, strings.Split(value, ","))
+	return nil
+}
+
+func (a *announceTiers) String() string {
+	tiers := make([]string, len(*a))
+	for i, tier := range *a {
+		tiers[i] = strings.Join(tier, ",")
+	}
+	return strings.Join(tiers, " ")
+}
+
+// resolveAnnounceTiers applies the CLI's --announce semantics on top of
+// the raw parsed flag value: a single occurrence with comma-separated
+// URLs falls back to the old flat behavior (every URL its own tier), for
+// compatibility with the pre-BEP12 --announce; repeating --announce
+// builds real tiers instead. URLs within each tier are then shuffled, per
+// BEP 12's recommendation that a client randomize tracker order within a
+// tier rather than always trying them in the same sequence.
+func resolveAnnounceTiers(tiers announceTiers) [][]string {
+	if len(tiers) == 1 && len(tiers[0]) > 1 {
+		flat := make(announceTiers, len(tiers[0]))
+		for i, url := range tiers[0] {
+			flat[i] = []string{url}
+		}
+		tiers = flat
+	}
+
+	result := make([][]string, len(tiers))
+	for i, tier := range tiers {
+		shuffled := append([]string{}, tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		result[i] = shuffled
+	}
+	return result
+}
+
 var helpFlag = getopt.BoolLong("help", 'h', "Show this help message and exit")
 var versionFlag = getopt.BoolLong("version", 'V', "Print version and quit")
-var announceOpt = getopt.ListLong("announce", 'a', "Announce URLs\nAt least one must be specified", "<url>[,<url>,...]")
+var announceOpt announceTiers
+
+func init() {
+	getopt.FlagLong(&announceOpt, "announce", 'a', "Announce URL\nAt least one must be specified\nA single --announce with comma-separated URLs is one flat tier per URL; repeat --announce for real BEP 12 tiers", "<url>[,<url>,...]")
+}
+
 var commentOpt = getopt.StringLong("comment", 'c', "", "Add a comment to the torrent file")
 var pieceLengthOpt = getopt.UintLong("piece-length", 'l', 18, "Set the piece length to 2^n Bytes\ndefault is set to 18 = 2^18 Bytes = 256 KB")
 var nameOpt = getopt.StringLong("name", 'n', "", "Set the name of the metainfo\ndefault is the basename of the target")
@@ -51,6 +100,17 @@ var outputOpt = getopt.StringLong("output", 'o', "", "Set the path and filename
 var privateFlag = getopt.BoolLong("private", 'p', "Set the private flag")
 var verboseFlag = getopt.BoolLong("verbose", 'v', "be verbose")
 var debugFlag = getopt.BoolLong("debug", 'd', "debug output")
+var threadsOpt = getopt.UintLong("threads", 't', 0, "Number of piece hashing worker goroutines\ndefault is runtime.NumCPU()")
+var webSeedOpt = getopt.ListLong("web-seed", 'w', "Add a web seed URL (BEP 19)\ncan be specified multiple times", "<url>[,<url>,...]")
+var httpSeedOpt = getopt.ListLong("http-seed", 0, "Add a http seed URL (BEP 17)\ncan be specified multiple times", "<url>[,<url>,...]")
+var excludeOpt = getopt.ListLong("exclude", 0, "Exclude files matching this glob pattern (repeatable)\nUses doublestar syntax: * stays within one path segment, use ** to match across directories (e.g. **/*.log)\nDirectory mode only", "<pattern>")
+var includeOpt = getopt.ListLong("include", 0, "Include only files matching this glob pattern (repeatable)\nSame doublestar syntax as --exclude; applied after --exclude\nDirectory mode only", "<pattern>")
+var excludeFromOpt = getopt.StringLong("exclude-from", 0, "", "Read exclude patterns, one per line, from this file")
+var followSymlinksOpt = getopt.EnumLong("follow-symlinks", 0, []string{"no", "files", "all"}, "no", "Symlink policy for directory mode\nno = skip symlinks, files = follow symlinked files, all = follow symlinked files and directories", "{no,files,all}")
+var metaVersionOpt = getopt.EnumLong("meta-version", 0, []string{"1", "2", "hybrid"}, "1", "Metainfo version to create (BEP 52)\n1 = classic v1 torrent, 2 = v2 only, hybrid = v1+v2", "{1,2,hybrid}")
+var sourceOpt = getopt.StringLong("source", 0, "", "Set the info.source tag\nUsed by private trackers to derive a tracker-specific infohash from identical content")
+var noCreationDateFlag = getopt.BoolLong("no-creation-date", 0, "Omit the creation date, for reproducible output")
+var noCreatedByFlag = getopt.BoolLong("no-created-by", 0, "Omit the created-by field, for reproducible output")
 
 func main() {
 	getopt.SetParameters("<target directory or filename>")
@@ -67,7 +127,7 @@ func main() {
 		return
 	}
 
-	if len(*announceOpt) == 0 {
+	if len(announceOpt) == 0 {
 		fmt.Fprintln(os.Stderr, "You need to specify at least one announce URL!")
 		os.Exit(1)
 	}
@@ -86,52 +146,57 @@ func main() {
 		os.Exit(1)
 	}
 
-	tf := torrentfile.TorrentFile{}
+	name := *nameOpt
+	if name == "" {
+		name = filepath.Base(filename)
+	}
 
-	// Announce URLs
-	tf.AnnounceUrl = (*announceOpt)[0]
-	if len(*announceOpt) > 1 {
-		al := make([]string, len(*announceOpt)-1)
-		for i := 1; i < len(*announceOpt); i++ {
-			al[(i - 1)] = (*announceOpt)[i]
+	exclude := append([]string{}, *excludeOpt...)
+	if *excludeFromOpt != "" {
+		patterns, err := readPatternFile(*excludeFromOpt)
+		if err != nil {
+			log.Fatal(err)
 		}
-		tf.AnnounceList = al
+		exclude = append(exclude, patterns...)
 	}
 
-	// Comment
-	if *commentOpt != "" {
-		tf.Comment = *commentOpt
+	createdBy := "gomaketorrent " + VERSION
+	if *noCreatedByFlag {
+		createdBy = ""
 	}
-
-	// Name
-	if *nameOpt != "" {
-		tf.Name = *nameOpt
-	} else {
-		tf.Name = filepath.Base(filename)
+	var creationDate time.Time
+	if !*noCreationDateFlag {
+		creationDate = time.Now()
 	}
 
-	// Private flag
-	if *privateFlag {
-		tf.Private = true
+	builder := torrentfile.NewBuilder().
+		SetName(name).
+		SetAnnounce(resolveAnnounceTiers(announceOpt)).
+		SetComment(*commentOpt).
+		SetPieceLength(uint64(math.Pow(float64(2), float64(*pieceLengthOpt)))).
+		SetPrivate(*privateFlag).
+		SetThreads(int(*threadsOpt)).
+		SetDebug(*debugFlag).
+		SetCreatedBy(createdBy).
+		SetCreationDate(creationDate).
+		SetWebSeeds(*webSeedOpt).
+		SetHttpSeeds(*httpSeedOpt).
+		SetSource(*sourceOpt).
+		SetExclude(exclude).
+		SetInclude(*includeOpt).
+		SetSymlinkPolicy(*followSymlinksOpt).
+		SetVersion(*metaVersionOpt).
+		SetProgressFunc(onProgress)
+
+	if finfo.IsDir() {
+		builder = builder.AddDir(strings.TrimRight(filename, "/"))
+	} else {
+		builder = builder.AddFile(filename)
 	}
 
-	// Piece length
-	tf.PieceLength = uint64(math.Pow(float64(2), float64(*pieceLengthOpt)))
-
-	tf.CreatedBy = "gomaketorrent " + VERSION
-	tf.CreationDate = time.Now()
-	tf.Encoding = "UTF-8"
-
-	// Files
-	if finfo.IsDir() { // Dir mode
-		files, pieces := createFromDirectory(filename, tf.PieceLength)
-		tf.Files = files
-		tf.Pieces = pieces
-	} else { // Single file mode
-		tf.Files = make([]torrentfile.File, 1)
-		file, pieces := createFromSingleFile(filename, tf.PieceLength)
-		tf.Files[0] = file
-		tf.Pieces = pieces
+	tf, err := builder.Build(context.Background())
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Output
@@ -139,7 +204,7 @@ func main() {
 	if *outputOpt != "" {
 		outfile = *outputOpt
 	} else {
-		outfile = tf.Name + ".torrent"
+		outfile = name + ".torrent"
 	}
 	_, err = os.Stat(outfile)
 	if !os.IsNotExist(err) {
@@ -155,198 +220,75 @@ func main() {
 	}
 	defer fp.Close()
 
-	verboseOut("")
 	verboseOutNoNl("Writing .torrent file...")
 	writer := bufio.NewWriter(fp)
 	writer.Write(tf.Encode())
+	writer.Flush()
 	verboseOut("done")
 
 	fmt.Println()
+	switch *metaVersionOpt {
+	case "2":
+		fmt.Printf("infohash v2: %x\n", tf.InfoHashV2())
+	case "hybrid":
+		fmt.Printf("infohash v1: %x\n", tf.InfoHashV1())
+		fmt.Printf("infohash v2: %x\n", tf.InfoHashV2())
+	default:
+		fmt.Printf("infohash: %x\n", tf.InfoHash())
+	}
 }
 
-func askForConfirmation(s string) bool {
-	reader := bufio.NewReader(os.Stdin)
-
-	for {
-		fmt.Printf("%s [y/n]: ", s)
-
-		response, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		response = strings.ToLower(strings.TrimSpace(response))
-
-		if response == "y" || response == "yes" {
-			return true
-		} else if response == "n" || response == "no" {
-			return false
-		}
+// onProgress is the torrentfile.Builder progress-callback hook; it replaces
+// the verbose fmt.Println calls the hashing code used to make directly,
+// now that hashing happens inside the library.
+func onProgress(done, total uint64, message string) {
+	if message != "" {
+		verboseOut(message)
+		return
 	}
+	verboseOutNoNl(fmt.Sprintf("Hashed %d of %d pieces\r", done, total))
 }
 
-func createFromSingleFile(filename string, pieceLength uint64) (torrentfile.File, [][torrentfile.PIECE_SIZE]byte) {
-	finfo, _ := os.Stat(filename)
-	file := torrentfile.File{Path: finfo.Name(), Length: uint64(finfo.Size())}
-	nPieces := numPieces(file.Length, pieceLength)
-	verboseOut(fmt.Sprintf("%d bytes in all", file.Length))
-	verboseOut(fmt.Sprintf("That's %d pieces of %d bytes each", nPieces, pieceLength))
-
-	pieces := make([][torrentfile.PIECE_SIZE]byte, nPieces)
-
-	fp, err := os.Open(filename)
+// readPatternFile reads exclude glob patterns from path, one per line,
+// skipping blank lines and lines starting with '#'.
+func readPatternFile(path string) ([]string, error) {
+	fp, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer fp.Close()
-	reader := bufio.NewReader(fp)
-	pieceIndex := 0
 
-	for {
-		buf := make([]byte, pieceLength)
-		n, err := reader.Read(buf)
-		if err != nil && err != io.EOF {
-			log.Fatal(err)
-		} else if err == io.EOF {
-			break
-		}
-		if n < int(pieceLength) {
-			pieceBuf := make([]byte, n)
-			copy(pieceBuf, buf)
-			buf = pieceBuf
+	var patterns []string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		pieces[pieceIndex] = sha1.Sum(buf)
-		verboseOut(fmt.Sprintf("Hashed %d of %d pieces", pieceIndex+1, nPieces))
-		pieceIndex++
+		patterns = append(patterns, line)
 	}
-
-	return file, pieces
+	return patterns, scanner.Err()
 }
 
-func createFromDirectory(filename string, pieceLength uint64) ([]torrentfile.File, [][torrentfile.PIECE_SIZE]byte) {
-	filename = strings.TrimRight(filename, "/")
-	files := collectFiles(filename)
-	var totalSize uint64
-	debug(fmt.Sprintf("Number of files: %d", len(files)))
-
-	for i, f := range files {
-		files[i].Path = strings.TrimPrefix(f.Path, filename+"/") // there must be a better way to alter the path
-		totalSize += f.Length
-		verboseOut(fmt.Sprintf("Adding %s (%d bytes)", files[i].Path, f.Length))
-	}
-
-	numPieces := numPieces(totalSize, pieceLength)
-	verboseOut(fmt.Sprintf("%d bytes in all", totalSize))
-	verboseOut(fmt.Sprintf("That's %d pieces of %d bytes each", numPieces, pieceLength))
-
-	pieces := make([][torrentfile.PIECE_SIZE]byte, numPieces)
+func askForConfirmation(s string) bool {
+	reader := bufio.NewReader(os.Stdin)
 
-	bufLen := pieceLength
-	pieceIndex := 0
-	pieceBuf := make([]byte, pieceLength)
-	off := uint64(0)
-	c := make(chan piece)
+	for {
+		fmt.Printf("%s [y/n]: ", s)
 
-	for _, f := range files {
-		fp, err := os.Open(filename + "/" + f.Path)
+		response, err := reader.ReadString('\n')
 		if err != nil {
-			fp.Close()
 			log.Fatal(err)
 		}
-		reader := bufio.NewReader(fp)
-
-		for {
-			buf := make([]byte, bufLen)
-			n, err := reader.Read(buf)
-			if err != nil && err != io.EOF {
-				log.Fatal(err)
-			} else if err == io.EOF {
-				break
-			}
-			length := uint64(n)
-
-			if length < bufLen { // got less bytes than pieceLen from file (reached EOF while reading)
-				debug(fmt.Sprintf("p#%d Got only %d bytes", pieceIndex, length))
-				bufLen = pieceLength - length
-				debug(fmt.Sprintf("New bufLen = %d bytes", bufLen))
-				debug(fmt.Sprintf("pieceBuf[%d] = 0x%X", off, pieceBuf[off]))
-				copy(pieceBuf[off:], buf[:length]) // copy length bytes from buf to pieceBuf
-				debug(fmt.Sprintf("copy(pieceBuf[%d:], buf[:%d])", off, length))
-				off = length // set new offset for pieceBuf to length
-				debug(fmt.Sprintf("New offset: %d", off))
-			} else if off != 0 { // got the remaining bytes from the next file
-				debug(fmt.Sprintf("p#%d Got all %d bytes, resetting offset and bufLen", pieceIndex, length))
-				debug(fmt.Sprintf("pieceBuf[%d] = 0x%X", off, pieceBuf[off]))
-				copy(pieceBuf[off:], buf) // copy remaining bytes from buf to pieceBuf
-				debug(fmt.Sprintf("copy(pieceBuf[%d:], buf[:%d])", off, length))
-				off = 0 // reset offset and bufLen
-				bufLen = pieceLength
-				debug(fmt.Sprintf("reset offset to 0 and bufLen to %d", pieceLength))
-			} else { // normal operation, just copy buf to pieceBuf
-				copy(pieceBuf, buf)
-			}
-
-			if off == 0 { // hash the piece if offset is zero
-				go buildHash(piece{index: pieceIndex}, pieceBuf, c)
-				//pieces[pieceIndex] = sha1.Sum(pieceBuf)
-				//verboseOut(fmt.Sprintf("Hashed %d of %d pieces", pieceIndex+1, numPieces))
-				pieceIndex++
-			}
-		}
-
-		fp.Close()
-	}
-
-	// add remaining bytes from buffer
-	if off != 0 {
-		debug(fmt.Sprintf("Add %d remaining bytes to pieces list at index %d", off, pieceIndex))
-		//pieces[pieceIndex] = sha1.Sum(pieceBuf[:off])
-		go buildHash(piece{index: pieceIndex}, pieceBuf, c)
-		//verboseOut(fmt.Sprintf("Hashed %d of %d pieces", pieceIndex+1, numPieces))
-	}
 
-	verboseOut("")
-	for i := uint64(0); i < numPieces; i++ {
-		p := <-c
-		pieces[p.index] = p.hash
-		verboseOutNoNl(fmt.Sprintf("Hashed %d of %d pieces\r", p.index+1, numPieces))
-	}
-	verboseOut("")
-
-	return files, pieces
-}
-
-type piece struct {
-	index int
-	hash  [torrentfile.PIECE_SIZE]byte
-}
-
-func buildHash(p piece, data []byte, c chan piece) {
-	p.hash = sha1.Sum(data)
-	c <- p
-}
+		response = strings.ToLower(strings.TrimSpace(response))
 
-func collectFiles(filename string) []torrentfile.File {
-	var filelist []torrentfile.File
-	files, err := ioutil.ReadDir(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	for _, f := range files {
-		if f.IsDir() {
-			for _, inner := range collectFiles(filename + "/" + f.Name()) {
-				filelist = append(filelist, inner)
-			}
-		} else {
-			filelist = append(filelist, torrentfile.File{Length: uint64(f.Size()), Path: filename + "/" + f.Name()})
+		if response == "y" || response == "yes" {
+			return true
+		} else if response == "n" || response == "no" {
+			return false
 		}
 	}
-
-	return filelist
-}
-
-func numPieces(filesize, pieceLength uint64) uint64 {
-	return uint64(math.Ceil(float64(filesize) / float64(pieceLength)))
 }
 
 func verboseOut(s string) {
@@ -360,10 +302,3 @@ func verboseOutNoNl(s string) {
 		fmt.Print(s)
 	}
 }
-
-func debug(v interface{}) {
-	if *debugFlag {
-		fmt.Print("debug: ")
-		fmt.Println(v)
-	}
-}
@@ -0,0 +1,635 @@
+package torrentfile
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ProgressFunc is called as pieces are hashed (done, total, "") and for
+// free-form status lines (0, 0, message).
+type ProgressFunc func(done, total uint64, message string)
+
+// Builder assembles a TorrentFile from one or more files on disk. Its
+// methods are chainable so callers (the CLI, or any other Go program) can
+// configure it fluently and call Build once every input is known.
+type Builder struct {
+	name         string
+	announceURL  string
+	announceList [][]string
+	comment      string
+	pieceLength  uint64
+	private      bool
+	createdBy    string
+	creationDate time.Time
+	encoding     string
+	webSeeds     []string
+	httpSeeds    []string
+	source       string
+	threads      int
+	debug        bool
+	progress     ProgressFunc
+
+	dir           string
+	files         []string // explicit file paths, in AddFile call order
+	dirAdded      bool
+	exclude       []string
+	include       []string
+	symlinkPolicy string
+	version       string
+}
+
+// NewBuilder returns a Builder with the repository's historical CLI
+// defaults (UTF-8 encoding, unset threads resolved at Build time, symlinks
+// skipped in directory mode, BEP 3 v1 metainfo). The piece length has no
+// default: Build returns an error unless SetPieceLength was called.
+func NewBuilder() *Builder {
+	return &Builder{encoding: "UTF-8", symlinkPolicy: "no", version: "1"}
+}
+
+func (b *Builder) SetName(name string) *Builder {
+	b.name = name
+	return b
+}
+
+// SetAnnounce sets the announce URLs from a BEP 12 tier list: the first URL
+// of the first tier becomes the top-level "announce" field for BEP 3-only
+// clients, while every tier populates "announce-list" in full, including
+// the first.
+func (b *Builder) SetAnnounce(tiers [][]string) *Builder {
+	if len(tiers) == 0 || len(tiers[0]) == 0 {
+		return b
+	}
+	b.announceURL = tiers[0][0]
+	b.announceList = tiers
+	return b
+}
+
+func (b *Builder) SetComment(comment string) *Builder {
+	b.comment = comment
+	return b
+}
+
+func (b *Builder) SetPieceLength(pieceLength uint64) *Builder {
+	b.pieceLength = pieceLength
+	return b
+}
+
+func (b *Builder) SetPrivate(private bool) *Builder {
+	b.private = private
+	return b
+}
+
+// SetWebSeeds sets the BEP 19 url-list entries.
+func (b *Builder) SetWebSeeds(urls []string) *Builder {
+	b.webSeeds = urls
+	return b
+}
+
+// SetHttpSeeds sets the BEP 17 httpseeds entries.
+func (b *Builder) SetHttpSeeds(urls []string) *Builder {
+	b.httpSeeds = urls
+	return b
+}
+
+// SetSource sets info["source"], used by private trackers to derive a
+// tracker-specific infohash from otherwise identical content.
+func (b *Builder) SetSource(source string) *Builder {
+	b.source = source
+	return b
+}
+
+func (b *Builder) SetCreatedBy(createdBy string) *Builder {
+	b.createdBy = createdBy
+	return b
+}
+
+func (b *Builder) SetCreationDate(t time.Time) *Builder {
+	b.creationDate = t
+	return b
+}
+
+// SetThreads sets the number of hashing worker goroutines. n <= 0 means
+// runtime.NumCPU().
+func (b *Builder) SetThreads(n int) *Builder {
+	b.threads = n
+	return b
+}
+
+func (b *Builder) SetDebug(debug bool) *Builder {
+	b.debug = debug
+	return b
+}
+
+// SetProgressFunc installs a progress-callback hook, invoked as pieces are
+// hashed, instead of the CLI printing directly.
+func (b *Builder) SetProgressFunc(fn ProgressFunc) *Builder {
+	b.progress = fn
+	return b
+}
+
+// AddFile adds a single file, listed under its base name. Each call appends
+// one more file; files added this way are ignored once AddDir is called.
+func (b *Builder) AddFile(path string) *Builder {
+	b.files = append(b.files, path)
+	return b
+}
+
+// AddDir adds every regular file under dir, recursively.
+func (b *Builder) AddDir(dir string) *Builder {
+	b.dir = dir
+	b.dirAdded = true
+	return b
+}
+
+// SetExclude sets glob patterns (matched against each file's path relative
+// to the added directory) that exclude a file from the torrent. Directory
+// mode only.
+func (b *Builder) SetExclude(patterns []string) *Builder {
+	b.exclude = patterns
+	return b
+}
+
+// SetInclude sets glob patterns that a file's relative path must match to
+// be kept; applied after SetExclude. An empty list includes everything.
+// Directory mode only.
+func (b *Builder) SetInclude(patterns []string) *Builder {
+	b.include = patterns
+	return b
+}
+
+// SetSymlinkPolicy controls how symlinks are handled in directory mode:
+// "no" skips them, "files" follows symlinked files but skips symlinked
+// directories, "all" follows both.
+func (b *Builder) SetSymlinkPolicy(policy string) *Builder {
+	b.symlinkPolicy = policy
+	return b
+}
+
+// SetVersion selects the BEP 52 metainfo version: "1" (default), "2" or
+// "hybrid".
+func (b *Builder) SetVersion(version string) *Builder {
+	b.version = version
+	return b
+}
+
+func (b *Builder) debugf(format string, args ...interface{}) {
+	if b.debug {
+		log.Printf("debug: "+format, args...)
+	}
+}
+
+func (b *Builder) reportProgress(done, total uint64, message string) {
+	if b.progress != nil {
+		b.progress(done, total, message)
+	}
+}
+
+// Build walks the configured inputs, hashes every piece across a bounded
+// worker pool and assembles the resulting TorrentFile. Every file is read
+// exactly once: when the metainfo version requires it, the v2 merkle tree
+// for a file is built from the same bytes streamed past for v1 piece
+// hashing, not a second pass over the file.
+func (b *Builder) Build(ctx context.Context) (*TorrentFile, error) {
+	if b.pieceLength == 0 {
+		return nil, fmt.Errorf("torrentfile: piece length must be set")
+	}
+
+	version := b.version
+	if version == "" {
+		version = "1"
+	}
+	needV2 := version == "2" || version == "hybrid"
+
+	// files holds the bencoded File entries (Path relative to the torrent
+	// root); diskPaths holds the matching on-disk path to actually read
+	// from, which for single-file mode is not the same thing: File.Path
+	// is just the basename, while the disk path is whatever AddFile was
+	// given.
+	var files []File
+	var diskPaths []string
+
+	if b.dirAdded {
+		baseDir := b.dir
+		var err error
+		files, err = collectFiles(baseDir, b.exclude, b.include, b.symlinkPolicy)
+		if err != nil {
+			return nil, err
+		}
+		b.debugf("collected %d files from %s", len(files), baseDir)
+		diskPaths = make([]string, len(files))
+		for i, f := range files {
+			diskPaths[i] = baseDir + "/" + f.Path
+		}
+	} else {
+		for _, path := range b.files {
+			finfo, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, File{Path: finfo.Name(), Length: uint64(finfo.Size())})
+			diskPaths = append(diskPaths, path)
+		}
+	}
+
+	// BEP 47 padding files align each file (except the last) on a piece
+	// boundary so a hybrid torrent's v1 piece stream matches what a
+	// v1-only client would hash. v2-only torrents don't need them: each
+	// file's merkle tree is independent of piece boundaries.
+	v1Files, v1DiskPaths := files, diskPaths
+	if version == "hybrid" {
+		v1Files, v1DiskPaths = padForHybrid(files, diskPaths, b.pieceLength)
+	}
+
+	sources := make([]hashSource, len(v1Files))
+	var totalSize uint64
+	for i, f := range v1Files {
+		totalSize += f.Length
+		pad := strings.HasPrefix(f.Path, ".pad/")
+		sources[i] = hashSource{path: v1DiskPaths[i], length: f.Length, pad: pad, v2: needV2 && !pad}
+	}
+
+	n := numPieces(totalSize, b.pieceLength)
+	pieces, v2Results, err := hashPieces(ctx, sources, b.pieceLength, n, b.threads, b.reportProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &TorrentFile{
+		Name:         b.name,
+		AnnounceUrl:  b.announceURL,
+		AnnounceList: b.announceList,
+		PieceLength:  b.pieceLength,
+		Pieces:       pieces,
+		Files:        v1Files,
+		Private:      b.private,
+		Comment:      b.comment,
+		CreatedBy:    b.createdBy,
+		CreationDate: b.creationDate,
+		Encoding:     b.encoding,
+		WebSeeds:     b.webSeeds,
+		HttpSeeds:    b.httpSeeds,
+		Source:       b.source,
+		Version:      version,
+	}
+
+	if needV2 {
+		v2Files := make([]V2File, 0, len(files))
+		layers := make(map[string]string)
+		for i, src := range sources {
+			if src.pad {
+				continue
+			}
+			r := v2Results[i]
+			v2Files = append(v2Files, V2File{Path: v1Files[i].Path, Length: v1Files[i].Length, Root: r.root})
+			if len(r.layer) > 0 {
+				layers[string(r.root[:])] = string(r.layer)
+			}
+		}
+		tf.V2Files = v2Files
+		tf.PieceLayers = layers
+	}
+
+	return tf, nil
+}
+
+// padForHybrid inserts a BEP 47 ".pad/<size>" entry (with no disk path of
+// its own) after every file except the last, sized to round the running
+// total up to the next piece boundary. diskPaths is carried along
+// alongside files so the two slices stay index-aligned.
+func padForHybrid(files []File, diskPaths []string, pieceLength uint64) ([]File, []string) {
+	if len(files) == 0 {
+		return files, diskPaths
+	}
+
+	paddedFiles := make([]File, 0, len(files)*2)
+	paddedPaths := make([]string, 0, len(files)*2)
+	var offset uint64
+	for i, f := range files {
+		paddedFiles = append(paddedFiles, f)
+		paddedPaths = append(paddedPaths, diskPaths[i])
+		offset += f.Length
+		if i == len(files)-1 {
+			break
+		}
+		if rem := offset % pieceLength; rem != 0 {
+			padSize := pieceLength - rem
+			paddedFiles = append(paddedFiles, File{Path: fmt.Sprintf(".pad/%d", padSize), Length: padSize})
+			paddedPaths = append(paddedPaths, "")
+			offset += padSize
+		}
+	}
+	return paddedFiles, paddedPaths
+}
+
+// collectFiles walks dir recursively and returns every file found, with
+// paths relative to dir, sorted lexicographically for deterministic output
+// (BEP 3 implies canonical ordering). exclude/include are glob patterns
+// matched against each file's relative path; symlinkPolicy is "no",
+// "files" or "all". Every directory visited, symlinked or not, is tracked
+// by device+inode so a symlink cycle (or two symlinks aliasing the same
+// directory) is skipped instead of walked forever.
+func collectFiles(dir string, exclude, include []string, symlinkPolicy string) ([]File, error) {
+	var files []File
+	visited := make(map[[2]uint64]bool)
+
+	if rootInfo, err := os.Stat(dir); err == nil {
+		if key, ok := inodeKey(rootInfo); ok {
+			visited[key] = true
+		}
+	}
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			full := path + "/" + e.Name()
+			info := os.FileInfo(e)
+			isDir := e.IsDir()
+
+			if e.Mode()&os.ModeSymlink != 0 {
+				target, ok := followSymlink(full, symlinkPolicy)
+				if !ok {
+					continue
+				}
+				info = target
+				isDir = target.IsDir()
+			}
+
+			if isDir {
+				if key, ok := inodeKey(info); ok {
+					if visited[key] {
+						continue // symlink cycle, or a directory aliased via two paths
+					}
+					visited[key] = true
+				}
+				if err := walk(full); err != nil {
+					return err
+				}
+				continue
+			}
+
+			rel := full[len(dir)+1:]
+			if excludedByFilters(rel, exclude, include) {
+				continue
+			}
+			files = append(files, File{Path: rel, Length: uint64(info.Size())})
+		}
+		return nil
+	}
+
+	if err := walk(dir); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return files, nil
+}
+
+// inodeKey returns info's device+inode, for detecting when two paths
+// (e.g. a symlink and its target, or two symlinks) name the same
+// directory. ok is false on platforms where the underlying Sys() value
+// isn't a *syscall.Stat_t, in which case cycle detection is skipped.
+func inodeKey(info os.FileInfo) ([2]uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return [2]uint64{}, false
+	}
+	return [2]uint64{uint64(st.Dev), st.Ino}, true
+}
+
+// followSymlink applies policy to a symlink directory entry at path,
+// returning the resolved target's FileInfo and whether it should be
+// walked/included at all.
+func followSymlink(path, policy string) (os.FileInfo, bool) {
+	if policy == "no" {
+		return nil, false
+	}
+	target, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if target.IsDir() && policy != "all" {
+		return nil, false
+	}
+	return target, true
+}
+
+// excludedByFilters reports whether rel should be left out of the
+// torrent: it is excluded if it matches any exclude pattern, or if
+// include patterns are set and it matches none of them. Patterns use
+// doublestar glob syntax: "*" stays within one path segment, so "*.log"
+// matches only at the root, while "**" crosses directory boundaries
+// ("**/*.log" matches at any depth).
+func excludedByFilters(rel string, exclude, include []string) bool {
+	for _, pat := range exclude {
+		if ok, _ := doublestar.Match(pat, rel); ok {
+			return true
+		}
+	}
+	if len(include) == 0 {
+		return false
+	}
+	for _, pat := range include {
+		if ok, _ := doublestar.Match(pat, rel); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// hashSource is one entry in the v1 piece stream: either a real file or,
+// for hybrid torrents, a virtual zero-filled BEP 47 padding span.
+type hashSource struct {
+	path   string
+	length uint64
+	pad    bool
+	v2     bool // build a BEP 52 merkle tree for this source as it is read
+}
+
+// v2Result is one source's finished BEP 52 merkle tree, populated only
+// for sources with v2 set.
+type v2Result struct {
+	root  [32]byte
+	layer []byte
+}
+
+// pieceJob carries a fully-owned, piece-sized buffer to a hashing worker.
+type pieceJob struct {
+	index int
+	data  []byte
+}
+
+// pieceResult carries a worker's finished hash back to the collector.
+type pieceResult struct {
+	index int
+	hash  [PIECE_SIZE]byte
+}
+
+// hashPieces streams the concatenation of sources in order, splits it into
+// pieceLength-sized chunks and hashes them across a bounded worker pool.
+// Every job buffer is drawn from a sync.Pool and owned solely by the
+// worker it is sent to, so concurrent workers never race on shared memory.
+//
+// A source with v2 set additionally gets its BEP 52 merkle tree built from
+// the very same bytes as they are read off disk for v1 piece hashing, so
+// each file is only ever read once regardless of which metainfo version it
+// feeds.
+func hashPieces(ctx context.Context, sources []hashSource, pieceLength uint64, nPieces uint64, threads int, progress ProgressFunc) ([][PIECE_SIZE]byte, []v2Result, error) {
+	bufPool := sync.Pool{New: func() interface{} { return make([]byte, pieceLength) }}
+
+	numWorkers := threads
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+
+	jobs := make(chan pieceJob, numWorkers)
+	results := make(chan pieceResult, numWorkers)
+	errs := make(chan error, 1)
+
+	var workers sync.WaitGroup
+	workers.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				results <- pieceResult{index: job.index, hash: sha1.Sum(job.data)}
+				bufPool.Put(job.data[:pieceLength])
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	v2Results := make([]v2Result, len(sources))
+
+	// Single reader goroutine: streams bytes across file boundaries and
+	// emits fully-owned piece buffers into the jobs channel.
+	go func() {
+		defer close(jobs)
+
+		pieceIndex := 0
+		buf := bufPool.Get().([]byte)[:pieceLength]
+		off := uint64(0)
+
+		for si, src := range sources {
+			if ctx.Err() != nil {
+				errs <- ctx.Err()
+				return
+			}
+
+			var acc *merkleV2Accumulator
+			if src.v2 {
+				acc = &merkleV2Accumulator{}
+			}
+
+			if src.pad {
+				remaining := src.length
+				for remaining > 0 {
+					n := pieceLength - off
+					if n > remaining {
+						n = remaining
+					}
+					for i := uint64(0); i < n; i++ {
+						buf[off+i] = 0
+					}
+					off += n
+					remaining -= n
+					if off == pieceLength {
+						jobs <- pieceJob{index: pieceIndex, data: buf}
+						pieceIndex++
+						off = 0
+						buf = bufPool.Get().([]byte)[:pieceLength]
+					}
+				}
+				continue
+			}
+
+			err := func() error {
+				fp, err := os.Open(src.path)
+				if err != nil {
+					return err
+				}
+				defer fp.Close()
+				reader := bufio.NewReader(fp)
+
+				for {
+					n, err := io.ReadFull(reader, buf[off:])
+					if acc != nil && n > 0 {
+						acc.Write(buf[off : off+uint64(n)])
+					}
+					off += uint64(n)
+					if err == io.EOF || err == io.ErrUnexpectedEOF {
+						return nil // source exhausted, carry the partial piece over to the next source
+					} else if err != nil {
+						return err
+					}
+
+					jobs <- pieceJob{index: pieceIndex, data: buf}
+					pieceIndex++
+					off = 0
+					buf = bufPool.Get().([]byte)[:pieceLength]
+				}
+			}()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if acc != nil {
+				root, layer := acc.Finish()
+				v2Results[si] = v2Result{root: root, layer: layer}
+			}
+		}
+
+		if off > 0 {
+			jobs <- pieceJob{index: pieceIndex, data: buf[:off]}
+		}
+	}()
+
+	pieces := make([][PIECE_SIZE]byte, nPieces)
+	var done uint64
+	for r := range results {
+		pieces[r.index] = r.hash
+		done++
+		progress(done, nPieces, "")
+	}
+
+	select {
+	case err := <-errs:
+		return nil, nil, err
+	default:
+	}
+
+	return pieces, v2Results, nil
+}
+
+func numPieces(filesize, pieceLength uint64) uint64 {
+	if filesize == 0 {
+		return 0
+	}
+	n := filesize / pieceLength
+	if filesize%pieceLength != 0 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,163 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestHashPiecesSpansFiles checks that pieces are hashed over the
+// concatenation of sources, including a piece that spans a file
+// boundary, for both a single-worker and a many-worker pool.
+func TestHashPiecesSpansFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := make([]byte, 6)
+	b := make([]byte, 6)
+	for i := range a {
+		a[i] = byte(i + 1)
+	}
+	for i := range b {
+		b[i] = byte(i + 100)
+	}
+	pathA := writeTempFile(t, dir, "a.bin", a)
+	pathB := writeTempFile(t, dir, "b.bin", b)
+
+	const pieceLength = 8
+	sources := []hashSource{
+		{path: pathA, length: uint64(len(a))},
+		{path: pathB, length: uint64(len(b))},
+	}
+
+	want := [][PIECE_SIZE]byte{
+		sha1.Sum(append(append([]byte{}, a...), b[:2]...)),
+		sha1.Sum(b[2:6]),
+	}
+
+	for _, threads := range []int{1, 4} {
+		pieces, _, err := hashPieces(context.Background(), sources, pieceLength, 2, threads, func(uint64, uint64, string) {})
+		if err != nil {
+			t.Fatalf("threads=%d: %v", threads, err)
+		}
+		if pieces[0] != want[0] || pieces[1] != want[1] {
+			t.Errorf("threads=%d: got pieces %x / %x, want %x / %x", threads, pieces[0], pieces[1], want[0], want[1])
+		}
+	}
+}
+
+// TestHashPiecesPad checks that a pad source contributes zero bytes to
+// the v1 piece stream without reading anything from disk.
+func TestHashPiecesPad(t *testing.T) {
+	dir := t.TempDir()
+	a := []byte{1, 2, 3, 4}
+	pathA := writeTempFile(t, dir, "a.bin", a)
+
+	const pieceLength = 8
+	sources := []hashSource{
+		{path: pathA, length: uint64(len(a))},
+		{pad: true, length: 4},
+	}
+
+	want := sha1.Sum(append(append([]byte{}, a...), make([]byte, 4)...))
+
+	pieces, _, err := hashPieces(context.Background(), sources, pieceLength, 1, 2, func(uint64, uint64, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pieces[0] != want {
+		t.Errorf("got %x, want %x", pieces[0], want)
+	}
+}
+
+// TestBuildSingleFileUsesRealDiskPath guards against the single-file mode
+// regression where AddFile paths outside the working directory could not
+// be opened because the hasher used the bencoded basename as the disk
+// path instead of the path AddFile was given.
+func TestBuildSingleFileUsesRealDiskPath(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "nested")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTempFile(t, sub, "a.txt", []byte("hello"))
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := NewBuilder().SetPieceLength(16).AddFile(path).Build(context.Background())
+	if err != nil {
+		t.Fatalf("Build failed, single-file mode likely resolved the wrong disk path: %v", err)
+	}
+	if len(tf.Files) != 1 || tf.Files[0].Path != "a.txt" {
+		t.Fatalf("unexpected Files: %+v", tf.Files)
+	}
+}
+
+// TestNumPieces checks the ceiling-division edge cases: an exact multiple
+// of the piece length, a remainder, and a zero-length torrent.
+func TestNumPieces(t *testing.T) {
+	cases := []struct {
+		size, pieceLength, want uint64
+	}{
+		{0, 8, 0},
+		{8, 8, 1},
+		{9, 8, 2},
+		{17, 8, 3},
+	}
+	for _, c := range cases {
+		if got := numPieces(c.size, c.pieceLength); got != c.want {
+			t.Errorf("numPieces(%d, %d) = %d, want %d", c.size, c.pieceLength, got, c.want)
+		}
+	}
+}
+
+// TestPadForHybridAlignsToPieceBoundary checks that padForHybrid inserts a
+// .pad entry sized to bring the next file onto a piece boundary, and
+// leaves an already-aligned file alone.
+func TestPadForHybridAlignsToPieceBoundary(t *testing.T) {
+	files := []File{
+		{Path: "a", Length: 3},
+		{Path: "b", Length: 8},
+		{Path: "c", Length: 0},
+	}
+	diskPaths := []string{"/a", "/b", "/c"}
+
+	gotFiles, gotDisk := padForHybrid(files, diskPaths, 8)
+
+	wantPaths := []string{"a", ".pad/5", "b", "c"}
+	if len(gotFiles) != len(wantPaths) {
+		t.Fatalf("got %d entries, want %d: %+v", len(gotFiles), len(wantPaths), gotFiles)
+	}
+	for i, want := range wantPaths {
+		if gotFiles[i].Path != want {
+			t.Errorf("entry %d: got path %q, want %q", i, gotFiles[i].Path, want)
+		}
+	}
+	if gotFiles[1].Length != 5 {
+		t.Errorf("pad length = %d, want 5", gotFiles[1].Length)
+	}
+	if gotDisk[1] != "" {
+		t.Errorf("pad disk path = %q, want empty", gotDisk[1])
+	}
+	// "c" is zero-length and already follows an aligned offset, so no pad
+	// should be inserted before it.
+	if gotFiles[3].Path != "c" {
+		t.Errorf("unexpected padding before zero-length file: %+v", gotFiles)
+	}
+}
@@ -0,0 +1,78 @@
+package torrentfile
+
+import "crypto/sha256"
+
+// leafSizeV2 is the fixed BEP 52 merkle leaf block size, independent of
+// the torrent's piece length.
+const leafSizeV2 = 16384
+
+// merkleV2Accumulator builds a BEP 52 SHA-256 merkle tree for one file from
+// a sequential stream of bytes handed to it as they are read off disk, so a
+// file's v1 piece hash and v2 merkle tree can be produced from a single
+// pass over its contents.
+type merkleV2Accumulator struct {
+	leaves  [][32]byte
+	partial []byte
+}
+
+func (m *merkleV2Accumulator) Write(p []byte) {
+	m.partial = append(m.partial, p...)
+	for len(m.partial) >= leafSizeV2 {
+		m.leaves = append(m.leaves, sha256.Sum256(m.partial[:leafSizeV2]))
+		m.partial = m.partial[leafSizeV2:]
+	}
+}
+
+// Finish flushes any trailing partial leaf (zero-padded to leafSizeV2) and
+// returns the merkle root plus, when there is more than one leaf, the
+// concatenated leaf hashes making up the BEP 52 "piece layers" entry.
+func (m *merkleV2Accumulator) Finish() (root [32]byte, layer []byte) {
+	if len(m.partial) > 0 {
+		var block [leafSizeV2]byte
+		copy(block[:], m.partial)
+		m.leaves = append(m.leaves, sha256.Sum256(block[:]))
+		m.partial = nil
+	}
+	if len(m.leaves) == 0 {
+		return root, nil
+	}
+	root = merkleRootV2(m.leaves)
+	if len(m.leaves) == 1 {
+		return root, nil
+	}
+	layer = make([]byte, 0, len(m.leaves)*32)
+	for _, h := range m.leaves {
+		layer = append(layer, h[:]...)
+	}
+	return root, layer
+}
+
+// merkleRootV2 computes the BEP 52 binary merkle root over leaves, padding
+// with hashes of an all-zero leaf block up to the next power of two.
+func merkleRootV2(leaves [][32]byte) [32]byte {
+	n := len(leaves)
+	size := 1
+	for size < n {
+		size *= 2
+	}
+
+	level := make([][32]byte, size)
+	copy(level, leaves)
+	if n < size {
+		zeroLeaf := sha256.Sum256(make([]byte, leafSizeV2))
+		for i := n; i < size; i++ {
+			level[i] = zeroLeaf
+		}
+	}
+
+	for len(level) > 1 {
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			pair := append(append([]byte{}, level[2*i][:]...), level[2*i+1][:]...)
+			next[i] = sha256.Sum256(pair)
+		}
+		level = next
+	}
+
+	return level[0]
+}
@@ -0,0 +1,112 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMerkleV2AccumulatorSingleLeaf checks that a file smaller than one
+// leaf block hashes to the SHA-256 of its zero-padded block, with no
+// piece-layer entry (BEP 52 omits "piece layers" for single-leaf files).
+func TestMerkleV2AccumulatorSingleLeaf(t *testing.T) {
+	var acc merkleV2Accumulator
+	data := []byte("hello world")
+	acc.Write(data)
+	root, layer := acc.Finish()
+
+	var block [leafSizeV2]byte
+	copy(block[:], data)
+	want := sha256.Sum256(block[:])
+
+	if root != want {
+		t.Errorf("root = %x, want %x", root, want)
+	}
+	if layer != nil {
+		t.Errorf("layer = %x, want nil for a single-leaf file", layer)
+	}
+}
+
+// TestMerkleV2AccumulatorMultiLeafPadding checks that a file spanning more
+// than one leaf, but not a power of two, is padded with hashes of an
+// all-zero leaf up to the next power of two before the root is computed,
+// and that the piece-layer entry covers only the real leaves.
+func TestMerkleV2AccumulatorMultiLeafPadding(t *testing.T) {
+	data := make([]byte, leafSizeV2*3) // 3 real leaves, rounds up to 4
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var acc merkleV2Accumulator
+	acc.Write(data[:leafSizeV2+100])
+	acc.Write(data[leafSizeV2+100:])
+	root, layer := acc.Finish()
+
+	if len(layer) != 3*32 {
+		t.Fatalf("layer length = %d, want %d (3 real leaves, no padding leaked into it)", len(layer), 3*32)
+	}
+
+	leaves := make([][32]byte, 3)
+	for i := range leaves {
+		leaves[i] = sha256.Sum256(data[i*leafSizeV2 : (i+1)*leafSizeV2])
+	}
+	zeroLeaf := sha256.Sum256(make([]byte, leafSizeV2))
+	h01 := sha256.Sum256(append(append([]byte{}, leaves[0][:]...), leaves[1][:]...))
+	h23 := sha256.Sum256(append(append([]byte{}, leaves[2][:]...), zeroLeaf[:]...))
+	wantRoot := sha256.Sum256(append(append([]byte{}, h01[:]...), h23[:]...))
+	if root != wantRoot {
+		t.Errorf("root = %x, want %x", root, wantRoot)
+	}
+	for i, h := range leaves {
+		if !bytes.Equal(layer[i*32:(i+1)*32], h[:]) {
+			t.Errorf("leaf %d in layer = %x, want %x", i, layer[i*32:(i+1)*32], h)
+		}
+	}
+}
+
+// TestMerkleV2AccumulatorEmpty checks that a file with no bytes written
+// produces a zero root and no layer, matching Build's treatment of
+// zero-length files as having no "pieces root".
+func TestMerkleV2AccumulatorEmpty(t *testing.T) {
+	var acc merkleV2Accumulator
+	root, layer := acc.Finish()
+	if root != ([32]byte{}) {
+		t.Errorf("root = %x, want zero value", root)
+	}
+	if layer != nil {
+		t.Errorf("layer = %x, want nil", layer)
+	}
+}
+
+// TestHashPiecesV2Result checks that hashPieces builds the same merkle
+// root for a v2-flagged source as an equivalent direct accumulator run,
+// confirming the single-pass tee into the v1 hasher doesn't disturb the
+// v2 tree.
+func TestHashPiecesV2Result(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, leafSizeV2+500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(dir, "f.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []hashSource{{path: path, length: uint64(len(data)), v2: true}}
+	_, v2Results, err := hashPieces(context.Background(), sources, 1<<18, numPieces(uint64(len(data)), 1<<18), 2, func(uint64, uint64, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want merkleV2Accumulator
+	want.Write(data)
+	wantRoot, _ := want.Finish()
+
+	if v2Results[0].root != wantRoot {
+		t.Errorf("hashPieces root = %x, want %x", v2Results[0].root, wantRoot)
+	}
+}
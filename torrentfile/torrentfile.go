@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2017 Daniel Müller
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package torrentfile builds and encodes BitTorrent metainfo (.torrent)
+// files. This is a fork of github.com/fuchsi/torrentfile vendored into
+// this repository so the CLI's BEP extensions have somewhere real to live.
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"strings"
+	"time"
+
+	"github.com/fuchsi/bencode"
+)
+
+const PIECE_SIZE = 20
+
+type TorrentFile struct {
+	Name         string
+	AnnounceUrl  string
+	AnnounceList [][]string // BEP 12 tiers; each inner slice is one tier's URLs
+	PieceLength  uint64
+	Pieces       [][PIECE_SIZE]byte
+	Files        []File
+	Private      bool
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Encoding     string
+	WebSeeds     []string // BEP 19 url-list
+	HttpSeeds    []string // BEP 17 httpseeds
+	Source       string   // info["source"], used by private trackers to derive a tracker-specific infohash
+
+	// Version selects the BEP 52 metainfo version: "1" (default), "2" or
+	// "hybrid". V2Files and PieceLayers are only populated, and only
+	// serialized, for "2" and "hybrid".
+	Version     string
+	V2Files     []V2File
+	PieceLayers map[string]string // pieces root -> concatenated leaf hashes
+}
+
+type File struct {
+	Length uint64
+	Path   string
+}
+
+// V2File is one file's BEP 52 v2 file-tree entry: its path relative to the
+// torrent root, its length, and the merkle root over its 16 KiB leaves
+// (meaningless and omitted when Length is 0).
+type V2File struct {
+	Path   string
+	Length uint64
+	Root   [32]byte
+}
+
+func (t TorrentFile) hasV1() bool {
+	return t.Version == "" || t.Version == "1" || t.Version == "hybrid"
+}
+
+func (t TorrentFile) hasV2() bool {
+	return t.Version == "2" || t.Version == "hybrid"
+}
+
+func (t TorrentFile) TotalSize() uint64 {
+	totalSize := uint64(0)
+
+	for _, file := range t.Files {
+		totalSize += file.Length
+	}
+
+	return totalSize
+}
+
+// InfoHash returns the BEP 3 (v1) SHA-1 infohash of the bencoded info
+// dict, computed fresh from the TorrentFile's fields so it is always
+// correct for torrents built via Builder, not just ones round-tripped
+// through decode.
+func (t TorrentFile) InfoHash() [PIECE_SIZE]byte {
+	return t.InfoHashV1()
+}
+
+// InfoHashV1 is InfoHash under its BEP 52 name.
+func (t TorrentFile) InfoHashV1() [PIECE_SIZE]byte {
+	return sha1.Sum(bencode.Encode(t.infoDict()))
+}
+
+// InfoHashV2 returns the BEP 52 SHA-256 infohash: the same info dict as
+// InfoHashV1, hashed with SHA-256 instead of SHA-1. A hybrid torrent's v1
+// and v2 infohashes both come from this one dict.
+func (t TorrentFile) InfoHashV2() [32]byte {
+	return sha256.Sum256(bencode.Encode(t.infoDict()))
+}
+
+func (t TorrentFile) Encode() []byte {
+	dict := make(map[string]interface{})
+
+	// global dict
+	dict["announce"] = t.AnnounceUrl
+	if len(t.AnnounceList) > 0 {
+		tiers := make([]interface{}, len(t.AnnounceList))
+		for i, tier := range t.AnnounceList {
+			tiers[i] = toInterfaceSlice(tier)
+		}
+		dict["announce-list"] = tiers
+	}
+	if t.CreationDate.Unix() > 0 {
+		dict["creation date"] = t.CreationDate.Unix()
+	}
+	if t.CreatedBy != "" {
+		dict["created by"] = t.CreatedBy
+	}
+	if t.Comment != "" {
+		dict["comment"] = t.Comment
+	}
+	if t.Encoding != "" {
+		dict["encoding"] = t.Encoding
+	}
+	if len(t.WebSeeds) == 1 {
+		dict["url-list"] = t.WebSeeds[0]
+	} else if len(t.WebSeeds) > 1 {
+		dict["url-list"] = toInterfaceSlice(t.WebSeeds)
+	}
+	if len(t.HttpSeeds) > 0 {
+		dict["httpseeds"] = toInterfaceSlice(t.HttpSeeds)
+	}
+	if t.hasV2() && len(t.PieceLayers) > 0 {
+		layers := make(map[string]interface{}, len(t.PieceLayers))
+		for root, layer := range t.PieceLayers {
+			layers[root] = layer
+		}
+		dict["piece layers"] = layers
+	}
+
+	dict["info"] = t.infoDict()
+
+	return bencode.Encode(dict)
+}
+
+// infoDict assembles the bencoded "info" dictionary shared by Encode and
+// the InfoHash* methods, so they can never disagree about what was hashed.
+// A hybrid torrent's info dict carries both the v1 and v2 keys; it is
+// hashed once with SHA-1 for InfoHashV1 and once with SHA-256 for
+// InfoHashV2.
+func (t TorrentFile) infoDict() map[string]interface{} {
+	info := make(map[string]interface{})
+
+	info["piece length"] = t.PieceLength
+	if t.Private {
+		info["private"] = 1
+	}
+	if t.Name != "" {
+		info["name"] = t.Name
+	}
+	if t.Source != "" {
+		info["source"] = t.Source
+	}
+
+	if t.hasV1() {
+		var pieces string
+		for _, v := range t.Pieces {
+			pieces += string(v[:])
+		}
+		info["pieces"] = pieces
+
+		// files list
+		singleFile := false
+		if len(t.Files) == 1 { // single file mode
+			if strings.Count(t.Files[0].Path, "/") == 0 { // really single file mode
+				singleFile = true
+				info["name"] = t.Files[0].Path
+				info["length"] = t.Files[0].Length
+			}
+		}
+		if !singleFile {
+			files := make([]interface{}, len(t.Files))
+			for i, v := range t.Files {
+				file := make(map[string]interface{}, 2)
+				file["length"] = v.Length
+				file["path"] = partitionPath(v.Path)
+				files[i] = file
+			}
+			info["files"] = files
+		}
+	}
+
+	if t.hasV2() {
+		info["meta version"] = 2
+		info["file tree"] = fileTree(t.V2Files)
+	}
+
+	return info
+}
+
+// fileTree builds the BEP 52 nested "file tree" dict from a flat v2 file
+// list, keyed by path component, down to a leaf dict keyed by the empty
+// string holding "length" and (for non-empty files) "pieces root".
+func fileTree(files []V2File) map[string]interface{} {
+	tree := make(map[string]interface{})
+	for _, f := range files {
+		parts := strings.Split(f.Path, "/")
+		node := tree
+		for _, p := range parts[:len(parts)-1] {
+			child, ok := node[p].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[p] = child
+			}
+			node = child
+		}
+		leaf := map[string]interface{}{"length": f.Length}
+		if f.Length > 0 {
+			leaf["pieces root"] = string(f.Root[:])
+		}
+		node[parts[len(parts)-1]] = map[string]interface{}{"": leaf}
+	}
+	return tree
+}
+
+func toInterfaceSlice(s []string) []interface{} {
+	l := make([]interface{}, len(s))
+	for i, v := range s {
+		l[i] = v
+	}
+	return l
+}
+
+func partitionPath(path string) []interface{} {
+	p := make([]interface{}, strings.Count(path, "/")+1)
+	for i, v := range strings.Split(path, "/") {
+		p[i] = v
+	}
+
+	return p
+}